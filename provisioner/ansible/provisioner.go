@@ -3,9 +3,13 @@ package ansible
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -21,6 +25,7 @@ import (
 	"sync"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
@@ -39,18 +44,55 @@ type Config struct {
 	ExtraArguments []string `mapstructure:"extra_arguments"`
 
 	// The main playbook file to execute.
-	PlaybookFile         string `mapstructure:"playbook_file"`
-	LocalPort            string `mapstructure:"local_port"`
-	SSHHostKeyFile       string `mapstructure:"ssh_host_key_file"`
-	SSHAuthorizedKeyFile string `mapstructure:"ssh_authorized_key_file"`
-	SFTPCmd              string `mapstructure:"sftp_command"`
-	inventoryFile        string
+	PlaybookFile         string   `mapstructure:"playbook_file"`
+	LocalPort            string   `mapstructure:"local_port"`
+	SSHHostKeyFiles      []string `mapstructure:"ssh_host_key_file"`
+	SSHAuthorizedKeyFile string   `mapstructure:"ssh_authorized_key_file"`
+	SFTPCmd              string   `mapstructure:"sftp_command"`
+
+	// Path to a CA public key. Any client that presents a user
+	// certificate signed by this CA, with "packer-ansible" among its
+	// valid principals, is authenticated without needing an
+	// ssh_authorized_key_file entry.
+	SSHAuthorizedCAFile string `mapstructure:"ssh_authorized_ca_file"`
+
+	// When true, ship a bundled JSON-lines callback plugin to Ansible and
+	// parse its per-task events instead of scraping stdout, so failures
+	// hidden behind ignore_errors still fail the build.
+	StructuredOutput bool `mapstructure:"ansible_structured_output"`
+
+	// Path to a requirements.yml used to install roles and collections
+	// with ansible-galaxy before the playbook runs.
+	GalaxyFile string `mapstructure:"galaxy_file"`
+
+	// The command used to install galaxy_file. Defaults to
+	// ansible-galaxy.
+	GalaxyCommand string `mapstructure:"galaxy_command"`
+
+	// The key type (rsa, ecdsa or ed25519) used when Packer generates the
+	// SSH proxy's host key instead of loading one from ssh_host_key_file.
+	// Defaults to rsa.
+	SSHHostKeyType string `mapstructure:"ssh_host_key_type"`
+
+	// The key size, in bits, used when generating a host key. Meaningless
+	// for ed25519. Defaults to 2048 for rsa and 256 for ecdsa.
+	SSHHostKeyBits int `mapstructure:"ssh_host_key_bits"`
+
+	// Passphrase to decrypt ssh_host_key_file with, if it is encrypted.
+	// If the file is encrypted and this is not set, the passphrase is
+	// requested through the UI instead.
+	SSHKeyPassphrase string `mapstructure:"ssh_key_passphrase"`
+
+	inventoryFile string
 }
 
 type Provisioner struct {
 	config  Config
 	adapter *adapter
 	done    chan struct{}
+
+	keyCacheLock sync.Mutex
+	keyCache     map[string]ssh.Signer
 }
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
@@ -71,6 +113,12 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 	if p.config.Command == "" {
 		p.config.Command = "ansible-playbook"
 	}
+	if p.config.SSHHostKeyType == "" {
+		p.config.SSHHostKeyType = "rsa"
+	}
+	if p.config.GalaxyCommand == "" {
+		p.config.GalaxyCommand = "ansible-galaxy"
+	}
 
 	var errs *packer.MultiError
 	err = validateFileConfig(p.config.PlaybookFile, "playbook_file", true)
@@ -80,19 +128,41 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 
 	// Check that the authorized key file exists ( this should really be called the public key )
 	// Check for either file ( if you specify either file you must specify both files )
-	if len(p.config.SSHAuthorizedKeyFile) > 0 || len(p.config.SSHHostKeyFile) > 0 {
+	if len(p.config.SSHAuthorizedKeyFile) > 0 || len(p.config.SSHHostKeyFiles) > 0 {
 		err = validateFileConfig(p.config.SSHAuthorizedKeyFile, "ssh_authorized_key_file", true)
 		if err != nil {
 			errs = packer.MultiErrorAppend(errs, err)
 		}
 
-		err = validateFileConfig(p.config.SSHHostKeyFile, "ssh_host_key_file", true)
+		for _, hostKeyFile := range p.config.SSHHostKeyFiles {
+			err = validateFileConfig(hostKeyFile, "ssh_host_key_file", true)
+			if err != nil {
+				log.Println(hostKeyFile, "does not exist")
+				errs = packer.MultiErrorAppend(errs, err)
+			}
+		}
+	}
+
+	if len(p.config.GalaxyFile) > 0 {
+		err = validateFileConfig(p.config.GalaxyFile, "galaxy_file", true)
 		if err != nil {
-			log.Println(p.config.SSHHostKeyFile, "does not exist")
 			errs = packer.MultiErrorAppend(errs, err)
 		}
 	}
 
+	if len(p.config.SSHAuthorizedCAFile) > 0 {
+		err = validateFileConfig(p.config.SSHAuthorizedCAFile, "ssh_authorized_ca_file", true)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	switch p.config.SSHHostKeyType {
+	case "rsa", "ecdsa", "ed25519":
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("ssh_host_key_type: %s is not one of rsa, ecdsa, ed25519", p.config.SSHHostKeyType))
+	}
+
 	if len(p.config.LocalPort) > 0 {
 		if _, err := strconv.ParseUint(p.config.LocalPort, 10, 16); err != nil {
 			errs = packer.MultiErrorAppend(errs, fmt.Errorf("local_port: %s must be a valid port", p.config.LocalPort))
@@ -106,79 +176,40 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 }
 
 type Keys struct {
-	public   ssh.PublicKey
-	private  ssh.Signer
-	filename string
+	public  ssh.PublicKey
+	private ssh.Signer
 }
 
-func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
-	ui.Say("Provisioning with Ansible...")
-
-	keyFactory := func(pubKeyFile string, privKeyFile string) (*Keys, error) {
-		var public ssh.PublicKey
-		var private ssh.Signer
-
-		if len(pubKeyFile) > 0 || len(privKeyFile) > 0 {
-			pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
-			if err != nil {
-				return nil, errors.New("Failed to read public key")
-			}
-			public, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
-			if err != nil {
-				return nil, errors.New("Failed to parse authorized key")
-			}
-
-			privateBytes, err := ioutil.ReadFile(privKeyFile)
-			if err != nil {
-				return nil, errors.New("Failed to load private host key")
-			}
-
-			private, err := ssh.ParsePrivateKey(privateBytes)
-			if err != nil {
-				return nil, errors.New("Failed to parse private host key")
-			}
-			return &Keys{public, private, privKeyFile}, nil
-		} else {
-			key, err := rsa.GenerateKey(rand.Reader, 2048)
-			if err != nil {
-				return nil, errors.New("Failed to generate key pair")
-			}
-			public, err = ssh.NewPublicKey(key.Public())
-			if err != nil {
-				return nil, errors.New("Failed to extract public key from generated key pair")
-			}
-			private, err = ssh.NewSignerFromKey(key)
-			if err != nil {
-				return nil, errors.New("Failed to extract private key from generated key pair")
-			}
-
-			// To support Ansible calling back to us we need to write
-			// this file down
-			privateKeyDer := x509.MarshalPKCS1PrivateKey(key)
-			privateKeyBlock := pem.Block{
-				Type:    "RSA PRIVATE KEY",
-				Headers: nil,
-				Bytes:   privateKeyDer,
-			}
-			tf, err := ioutil.TempFile("", "ansible-key")
-			if err != nil {
-				return nil, errors.New("failed to create temp file for generated key")
-			}
-			_, err = tf.Write(pem.EncodeToMemory(&privateKeyBlock))
-			if err != nil {
-				return nil, errors.New("failed to write private key to temp file")
-			}
+// authMethod describes how the ansible-playbook child process should prove
+// its identity to the SSH proxy: either a private key file on disk or a
+// forwarded ssh-agent socket holding the matching key.
+type authMethod struct {
+	privateKeyFile string
+	agentSocket    string
+}
 
-			err = tf.Close()
-			if err != nil {
-				return nil, errors.New("failed to close private key temp file")
-			}
+// args returns the ansible-playbook arguments needed to use this auth
+// method, if any.
+func (a authMethod) args() []string {
+	if a.privateKeyFile != "" {
+		return []string{"--private-key", a.privateKeyFile}
+	}
+	return nil
+}
 
-			return &Keys{public, private, tf.Name()}, nil
-		}
+// env returns extra environment variables the ansible-playbook child
+// process needs in order to use this auth method.
+func (a authMethod) env() []string {
+	if a.agentSocket != "" {
+		return []string{"SSH_AUTH_SOCK=" + a.agentSocket}
 	}
+	return nil
+}
 
-	k, err := keyFactory(p.config.SSHAuthorizedKeyFile, p.config.SSHHostKeyFile)
+func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
+	ui.Say("Provisioning with Ansible...")
+
+	k, auth, extraHostKeys, err := p.keyFactory(ui, p.config.SSHAuthorizedKeyFile, p.config.SSHHostKeyFiles)
 	if err != nil {
 		return err
 	}
@@ -198,6 +229,29 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 			return nil, nil
 		},
 	}
+
+	if p.config.SSHAuthorizedCAFile != "" {
+		caBytes, err := ioutil.ReadFile(p.config.SSHAuthorizedCAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read ssh_authorized_ca_file: %s", err)
+		}
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey(caBytes)
+		if err != nil {
+			return fmt.Errorf("Failed to parse ssh_authorized_ca_file: %s", err)
+		}
+
+		// Accepting any user cert signed by this CA is handled by
+		// ssh.CertChecker.Authenticate itself: it also enforces
+		// ValidBefore/ValidAfter, requires the connecting user to be a
+		// valid principal, and rejects any critical option other than
+		// source-address, since SupportedCriticalOptions is left empty.
+		// The PublicKeyCallback set below additionally requires the user
+		// to be "packer-ansible" and the cert to list its principals.
+		keyChecker.IsUserAuthority = func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caKey.Marshal())
+		}
+	}
+
 	config := &ssh.ServerConfig{
 		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
 			ui.Say(fmt.Sprintf("authentication attempt from %s to %s as %s using %s", conn.RemoteAddr(), conn.LocalAddr(), conn.User(), method))
@@ -207,6 +261,21 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	}
 
 	config.AddHostKey(k.private)
+	for _, hostKey := range extraHostKeys {
+		config.AddHostKey(hostKey)
+	}
+	if p.config.SSHAuthorizedCAFile != "" {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			if cert, ok := pubKey.(*ssh.Certificate); ok {
+				// A cert with no principals would be valid for every user.
+				if conn.User() != "packer-ansible" || len(cert.ValidPrincipals) == 0 {
+					ui.Say(fmt.Sprintf("certificate not valid for %s", conn.User()))
+					return nil, errors.New("authentication failed")
+				}
+			}
+			return keyChecker.Authenticate(conn, pubKey)
+		}
+	}
 
 	localListener, err := func() (net.Listener, error) {
 		port, _ := strconv.ParseUint(p.config.LocalPort, 10, 16)
@@ -247,6 +316,7 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		}
 		defer os.Remove(tf.Name())
 		inv := fmt.Sprintf("default ansible_ssh_host=127.0.0.1 ansible_ssh_user=packer-ansible ansible_ssh_port=%s", p.config.LocalPort)
+
 		_, err = tf.Write([]byte(inv))
 		if err != nil {
 			tf.Close()
@@ -259,7 +329,7 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		}()
 	}
 
-	if err := p.executeAnsible(ui, comm, k.filename); err != nil {
+	if err := p.executeAnsible(ui, comm, auth); err != nil {
 		return fmt.Errorf("Error executing Ansible: %s", err)
 	}
 
@@ -277,15 +347,92 @@ func (p *Provisioner) Cancel() {
 	os.Exit(0)
 }
 
-func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, authToken string) error {
+func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, auth authMethod) error {
 	playbook, _ := filepath.Abs(p.config.PlaybookFile)
 	inventory := p.config.inventoryFile
 
-	args := []string{playbook, "-i", inventory, "--private-key", authToken}
+	env := append([]string{}, os.Environ()...)
+	env = append(env, auth.env()...)
+
+	if p.config.GalaxyFile != "" {
+		galaxyEnv, cleanup, err := p.installGalaxyDependencies(ui)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		env = append(env, galaxyEnv...)
+	}
+
+	args := []string{playbook, "-i", inventory}
+	args = append(args, auth.args()...)
 	args = append(args, p.config.ExtraArguments...)
 
 	cmd := exec.Command(p.config.Command, args...)
 
+	var recap *Recap
+	var failures []string
+	onStdoutLine := ui.Message
+	if p.config.StructuredOutput {
+		callbackDir, err := ioutil.TempDir("", "packer-ansible-callback")
+		if err != nil {
+			return fmt.Errorf("Error preparing callback plugin: %s", err)
+		}
+		defer os.RemoveAll(callbackDir)
+
+		pluginPath := filepath.Join(callbackDir, "packer_json.py")
+		if err := ioutil.WriteFile(pluginPath, []byte(packerJSONCallbackPlugin), 0644); err != nil {
+			return fmt.Errorf("Error writing callback plugin: %s", err)
+		}
+
+		env = append(env,
+			"ANSIBLE_CALLBACK_PLUGINS="+callbackDir,
+			"ANSIBLE_STDOUT_CALLBACK=packer_json",
+			"ANSIBLE_LOAD_CALLBACK_PLUGINS=True",
+		)
+
+		onStdoutLine = func(line string) {
+			hostRecap, failure := handleAnsibleEvent(ui, line)
+			if hostRecap != nil {
+				recap = hostRecap
+			}
+			if failure != "" {
+				failures = append(failures, failure)
+			}
+		}
+	}
+	cmd.Env = env
+
+	ui.Say(fmt.Sprintf("Executing Ansible: %s", strings.Join(cmd.Args, " ")))
+	err := runStreamed(ui, cmd, onStdoutLine)
+
+	// runner_on_failed fires for every failed task, including ones marked
+	// ignore_errors, so it's what actually catches the case this feature
+	// exists for: a play that ignores its own failures and exits 0. The
+	// recap's "failures" counter can't be trusted for that, since Ansible
+	// records ignored failures under "ignored" instead.
+	if len(failures) > 0 {
+		return fmt.Errorf("Ansible reported %d failed task(s) (ansible-playbook may still have exited 0, e.g. due to ignore_errors): %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	if recap != nil {
+		for host, counts := range recap.Hosts {
+			if counts.Unreachable > 0 {
+				return fmt.Errorf("Ansible reported %d unreachable task(s) on %s", counts.Unreachable, host)
+			}
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Non-zero exit status: %s", err)
+	}
+
+	return nil
+}
+
+// runStreamed starts cmd, forwarding its stdout line-by-line to
+// onStdoutLine and its stderr line-by-line to ui.Message, then waits for
+// it to exit.
+func runStreamed(ui packer.Ui, cmd *exec.Cmd, onStdoutLine func(string)) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -296,10 +443,10 @@ func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, aut
 	}
 
 	wg := sync.WaitGroup{}
-	repeat := func(r io.ReadCloser) {
+	stream := func(r io.ReadCloser, handle func(string)) {
 		scanner := bufio.NewScanner(r)
 		for scanner.Scan() {
-			ui.Message(scanner.Text())
+			handle(scanner.Text())
 		}
 		if err := scanner.Err(); err != nil {
 			ui.Error(err.Error())
@@ -307,18 +454,417 @@ func (p *Provisioner) executeAnsible(ui packer.Ui, comm packer.Communicator, aut
 		wg.Done()
 	}
 	wg.Add(2)
-	go repeat(stdout)
-	go repeat(stderr)
+	go stream(stdout, onStdoutLine)
+	go stream(stderr, ui.Message)
 
-	ui.Say(fmt.Sprintf("Executing Ansible: %s", strings.Join(cmd.Args, " ")))
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 	wg.Wait()
-	err = cmd.Wait()
+	return cmd.Wait()
+}
+
+// installGalaxyDependencies installs the roles and collections declared in
+// galaxy_file into fresh temp directories via galaxy_command, and returns
+// the ANSIBLE_ROLES_PATH/ANSIBLE_COLLECTIONS_PATHS environment variables
+// the ansible-playbook child process needs to see them, plus a cleanup
+// func the caller should defer once the playbook run is done with them.
+func (p *Provisioner) installGalaxyDependencies(ui packer.Ui) ([]string, func(), error) {
+	noop := func() {}
+
+	galaxyFile, err := filepath.Abs(p.config.GalaxyFile)
 	if err != nil {
-		return fmt.Errorf("Non-zero exit status: %s", err)
+		return nil, noop, fmt.Errorf("Error resolving galaxy_file: %s", err)
 	}
 
-	return nil
+	rolesPath, err := ioutil.TempDir("", "packer-ansible-roles")
+	if err != nil {
+		return nil, noop, fmt.Errorf("Error preparing galaxy roles directory: %s", err)
+	}
+
+	collectionsPath, err := ioutil.TempDir("", "packer-ansible-collections")
+	if err != nil {
+		os.RemoveAll(rolesPath)
+		return nil, noop, fmt.Errorf("Error preparing galaxy collections directory: %s", err)
+	}
+
+	cleanup := func() {
+		os.RemoveAll(rolesPath)
+		os.RemoveAll(collectionsPath)
+	}
+
+	roleCmd := exec.Command(p.config.GalaxyCommand, "install", "-r", galaxyFile, "-p", rolesPath)
+	ui.Say(fmt.Sprintf("Executing Ansible Galaxy: %s", strings.Join(roleCmd.Args, " ")))
+	if err := runStreamed(ui, roleCmd, ui.Message); err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("Error installing galaxy roles: %s", err)
+	}
+
+	env := []string{"ANSIBLE_ROLES_PATH=" + prependPath(os.Getenv("ANSIBLE_ROLES_PATH"), rolesPath)}
+
+	hasCollections, err := galaxyFileDeclaresCollections(galaxyFile)
+	if err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("Error reading galaxy_file: %s", err)
+	}
+	if hasCollections {
+		collectionCmd := exec.Command(p.config.GalaxyCommand, "collection", "install", "-r", galaxyFile, "-p", collectionsPath)
+		ui.Say(fmt.Sprintf("Executing Ansible Galaxy: %s", strings.Join(collectionCmd.Args, " ")))
+		if err := runStreamed(ui, collectionCmd, ui.Message); err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("Error installing galaxy collections: %s", err)
+		}
+		env = append(env, "ANSIBLE_COLLECTIONS_PATHS="+prependPath(os.Getenv("ANSIBLE_COLLECTIONS_PATHS"), collectionsPath))
+	}
+
+	return env, cleanup, nil
+}
+
+// galaxyFileDeclaresCollections reports whether galaxyFile has a top-level
+// "collections:" key. "ansible-galaxy collection install -r" exits non-zero
+// on a roles-only requirements.yml ("nothing to install"), so
+// installGalaxyDependencies only runs it when there's actually something
+// for it to do.
+func galaxyFileDeclaresCollections(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "collections:") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// prependPath adds dir to the front of an existing ':'-separated path list,
+// so galaxy_file dependencies are found in addition to any roles/collections
+// path the user already has configured rather than replacing it outright.
+func prependPath(existing string, dir string) string {
+	if existing == "" {
+		return dir
+	}
+	return dir + string(os.PathListSeparator) + existing
+}
+
+// AnsibleEvent is one JSON-lines record emitted by the bundled packer_json
+// callback plugin.
+type AnsibleEvent struct {
+	Event string               `json:"event"`
+	Task  string               `json:"task,omitempty"`
+	Host  string               `json:"host,omitempty"`
+	Msg   string               `json:"msg,omitempty"`
+	Recap map[string]HostRecap `json:"recap,omitempty"`
+}
+
+// HostRecap mirrors the per-host counters from ansible's play recap.
+type HostRecap struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Unreachable int `json:"unreachable"`
+	Failed      int `json:"failures"`
+	Skipped     int `json:"skipped"`
+}
+
+// Recap is the play recap captured from the packer_json callback's final
+// "playbook_on_stats" event.
+type Recap struct {
+	Hosts map[string]HostRecap
+}
+
+// handleAnsibleEvent parses one line of packer_json output, forwards it to
+// ui as the appropriate Say/Error/Message call, and returns the play recap
+// once the final "playbook_on_stats" event is seen, plus a description of
+// the failure when the event is a "runner_on_failed" (this fires for
+// ignore_errors tasks too, unlike the recap's failure counter).
+func handleAnsibleEvent(ui packer.Ui, line string) (*Recap, string) {
+	var event AnsibleEvent
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		// Not one of our JSON records; forward it as-is.
+		ui.Message(line)
+		return nil, ""
+	}
+
+	switch event.Event {
+	case "task_start":
+		ui.Say(fmt.Sprintf("TASK [%s]", event.Task))
+	case "runner_on_ok":
+		ui.Message(fmt.Sprintf("%s | %s", event.Host, event.Task))
+	case "runner_on_failed":
+		ui.Error(fmt.Sprintf("%s | FAILED | %s: %s", event.Host, event.Task, event.Msg))
+		return nil, fmt.Sprintf("%s: %s (%s)", event.Host, event.Task, event.Msg)
+	case "runner_on_unreachable":
+		ui.Error(fmt.Sprintf("%s | UNREACHABLE: %s", event.Host, event.Msg))
+	case "playbook_on_stats":
+		return &Recap{Hosts: event.Recap}, ""
+	}
+
+	return nil, ""
+}
+
+// packerJSONCallbackPlugin is a minimal Ansible callback plugin, bundled
+// with Packer, that emits one JSON object per line describing each task's
+// outcome and the final play recap. executeAnsible parses this instead of
+// scraping Ansible's human-oriented output.
+const packerJSONCallbackPlugin = `
+import json
+
+from ansible.plugins.callback import CallbackBase
+
+DOCUMENTATION = """
+callback: packer_json
+type: stdout
+short_description: JSON-lines output consumed by the Packer ansible provisioner
+"""
+
+
+class CallbackModule(CallbackBase):
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = "stdout"
+    CALLBACK_NAME = "packer_json"
+
+    def _emit(self, **event):
+        print(json.dumps(event))
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._emit(event="task_start", task=task.get_name())
+
+    def v2_runner_on_ok(self, result):
+        self._emit(event="runner_on_ok", host=result._host.get_name(), task=result.task_name)
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._emit(
+            event="runner_on_failed",
+            host=result._host.get_name(),
+            task=result.task_name,
+            msg=result._result.get("msg", ""),
+        )
+
+    def v2_runner_on_unreachable(self, result):
+        self._emit(
+            event="runner_on_unreachable",
+            host=result._host.get_name(),
+            msg=result._result.get("msg", ""),
+        )
+
+    def v2_playbook_on_stats(self, stats):
+        recap = dict((host, stats.summarize(host)) for host in stats.processed.keys())
+        self._emit(event="playbook_on_stats", recap=recap)
+`
+
+// keyFactory builds the Keys used to authenticate the SSH proxy, the
+// authMethod the ansible-playbook child process should use to connect to
+// it, and any additional host keys the server should offer. When neither
+// pubKeyFile nor privKeyFiles is set, a fresh key pair (per
+// ssh_host_key_type/ssh_host_key_bits) is generated and written to a temp
+// file. When only pubKeyFile is set, signing is delegated to a running
+// ssh-agent so the private key material never has to be exposed to Packer.
+// Otherwise privKeyFiles[0] becomes the proxy's primary identity (read from
+// disk, prompting for a passphrase if it's encrypted) and any remaining
+// files are parsed and returned as extra host keys.
+func (p *Provisioner) keyFactory(ui packer.Ui, pubKeyFile string, privKeyFiles []string) (*Keys, authMethod, []ssh.Signer, error) {
+	if pubKeyFile != "" && len(privKeyFiles) == 0 {
+		k, auth, err := p.agentKeyFactory(pubKeyFile)
+		return k, auth, nil, err
+	}
+
+	if pubKeyFile != "" || len(privKeyFiles) > 0 {
+		pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+		if err != nil {
+			return nil, authMethod{}, nil, errors.New("Failed to read public key")
+		}
+		public, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+		if err != nil {
+			return nil, authMethod{}, nil, errors.New("Failed to parse authorized key")
+		}
+
+		private, err := p.loadPrivateKey(ui, privKeyFiles[0])
+		if err != nil {
+			return nil, authMethod{}, nil, err
+		}
+
+		var extraHostKeys []ssh.Signer
+		for _, hostKeyFile := range privKeyFiles[1:] {
+			signer, err := p.loadPrivateKey(ui, hostKeyFile)
+			if err != nil {
+				return nil, authMethod{}, nil, err
+			}
+			extraHostKeys = append(extraHostKeys, signer)
+		}
+
+		return &Keys{public, private}, authMethod{privateKeyFile: privKeyFiles[0]}, extraHostKeys, nil
+	}
+
+	public, private, pemBytes, err := generateHostKey(p.config.SSHHostKeyType, p.config.SSHHostKeyBits)
+	if err != nil {
+		return nil, authMethod{}, nil, err
+	}
+
+	// To support Ansible calling back to us we need to write
+	// this file down
+	tf, err := ioutil.TempFile("", "ansible-key")
+	if err != nil {
+		return nil, authMethod{}, nil, errors.New("failed to create temp file for generated key")
+	}
+	_, err = tf.Write(pemBytes)
+	if err != nil {
+		return nil, authMethod{}, nil, errors.New("failed to write private key to temp file")
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return nil, authMethod{}, nil, errors.New("failed to close private key temp file")
+	}
+
+	return &Keys{public, private}, authMethod{privateKeyFile: tf.Name()}, nil, nil
+}
+
+// generateHostKey creates a fresh key pair of the given type (rsa, ecdsa or
+// ed25519) and returns its public key, signer, and PEM-encoded private key.
+// bits selects the RSA modulus size (default 2048) or the ECDSA curve
+// (P-256, P-384 or P-521, default P-256); it is ignored for ed25519.
+func generateHostKey(keyType string, bits int) (ssh.PublicKey, ssh.Signer, []byte, error) {
+	var privateKey interface{}
+	var der []byte
+	var blockType string
+
+	switch keyType {
+	case "", "rsa":
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to generate RSA key pair")
+		}
+		privateKey = key
+		der = x509.MarshalPKCS1PrivateKey(key)
+		blockType = "RSA PRIVATE KEY"
+	case "ecdsa":
+		curve := elliptic.P256()
+		switch bits {
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to generate ECDSA key pair")
+		}
+		privateKey = key
+		der, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to marshal ECDSA key pair")
+		}
+		blockType = "EC PRIVATE KEY"
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to generate Ed25519 key pair")
+		}
+		privateKey = key
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, nil, errors.New("Failed to marshal Ed25519 key pair")
+		}
+		blockType = "PRIVATE KEY"
+	default:
+		return nil, nil, nil, fmt.Errorf("ssh_host_key_type: unsupported key type %s", keyType)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, nil, nil, errors.New("Failed to extract private key from generated key pair")
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return signer.PublicKey(), signer, pemBytes, nil
+}
+
+// agentKeyFactory delegates signing for pubKeyFile to a running ssh-agent
+// reachable via SSH_AUTH_SOCK, so the matching private key never has to be
+// read by Packer.
+func (p *Provisioner) agentKeyFactory(pubKeyFile string) (*Keys, authMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, authMethod{}, errors.New("ssh_authorized_key_file was set without ssh_host_key_file, but SSH_AUTH_SOCK is not set to delegate to ssh-agent")
+	}
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, authMethod{}, errors.New("Failed to read public key")
+	}
+	public, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes)
+	if err != nil {
+		return nil, authMethod{}, errors.New("Failed to parse authorized key")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, authMethod{}, fmt.Errorf("Failed to connect to ssh-agent at %s: %s", sock, err)
+	}
+	// conn is left open: the returned agent signer signs through it.
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, authMethod{}, fmt.Errorf("Failed to list keys from ssh-agent: %s", err)
+	}
+
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), public.Marshal()) {
+			return &Keys{public, signer}, authMethod{agentSocket: sock}, nil
+		}
+	}
+
+	return nil, authMethod{}, fmt.Errorf("ssh-agent at %s does not hold the private key for %s", sock, pubKeyFile)
+}
+
+// loadPrivateKey parses the private key at path, prompting for a passphrase
+// through ui (or using ssh_key_passphrase) if it's encrypted. Parsed
+// signers are cached by path so the passphrase is only requested once. The
+// cache lock is only held around the cache itself, not the file read or the
+// interactive passphrase prompt, so it never blocks on user I/O.
+func (p *Provisioner) loadPrivateKey(ui packer.Ui, path string) (ssh.Signer, error) {
+	p.keyCacheLock.Lock()
+	signer, ok := p.keyCache[path]
+	p.keyCacheLock.Unlock()
+	if ok {
+		return signer, nil
+	}
+
+	privateBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Failed to load private host key")
+	}
+
+	signer, err = ssh.ParsePrivateKey(privateBytes)
+	if _, missingPassphrase := err.(*ssh.PassphraseMissingError); missingPassphrase {
+		passphrase := p.config.SSHKeyPassphrase
+		if passphrase == "" {
+			passphrase, err = ui.Ask(fmt.Sprintf("Passphrase for %s:", path))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read passphrase: %s", err)
+			}
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, errors.New("Failed to parse private host key")
+	}
+
+	p.keyCacheLock.Lock()
+	defer p.keyCacheLock.Unlock()
+	if p.keyCache == nil {
+		p.keyCache = make(map[string]ssh.Signer)
+	}
+	p.keyCache[path] = signer
+
+	return signer, nil
 }
 
 func validateFileConfig(name string, config string, req bool) error {